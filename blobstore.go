@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BlobsPath is where downloaded layer and config blobs are stored, keyed by
+// their sha256 digest, so the same blob is never downloaded or stored twice
+// regardless of how many images/tags reference it.
+const BlobsPath = ".dockie/blobs/sha256"
+
+func blobsDir() string {
+	return must(filepath.Abs(BlobsPath))
+}
+
+// blobPath returns the on-disk path for a blob given a digest of the form
+// "sha256:<hex>". It panics on any other digest algorithm since that's all
+// the registry API we speak supports.
+func blobPath(digest string) string {
+	hash := strings.TrimPrefix(digest, "sha256:")
+	if hash == digest {
+		log.Panicf("unsupported digest algorithm: %s", digest)
+	}
+	return filepath.Join(blobsDir(), hash)
+}
+
+func hasBlob(digest string) bool {
+	_, err := os.Stat(blobPath(digest))
+	return err == nil
+}
+
+// fetchBlob downloads the blob for digest from url (if not already present
+// in the store) verifying its sha256 against digest as it streams, and
+// returns the path to the cached blob. Already-cached blobs are returned
+// without re-downloading.
+func fetchBlob(url, token, digest string) string {
+	path := blobPath(digest)
+	if hasBlob(digest) {
+		log.Printf("blob %s already present, skipping download", digest)
+		return path
+	}
+	noErr(os.MkdirAll(filepath.Dir(path), 0755))
+
+	log.Printf("downloading blob %s", digest)
+	res := fetch(url, token)
+	defer func() { _ = res.Body.Close() }()
+
+	tmp := must(os.CreateTemp(filepath.Dir(path), ".tmp-*"))
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	hasher := sha256.New()
+	_ = must(io.Copy(io.MultiWriter(tmp, hasher), res.Body))
+	noErr(tmp.Close())
+
+	sum := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
+	if sum != digest {
+		log.Panicf("digest mismatch for %s: got %s", digest, sum)
+	}
+	noErr(os.Rename(tmp.Name(), path))
+	return path
+}
+
+// Gc walks every image manifest under ImagesPath to compute the set of
+// blobs still referenced by some image, then deletes any blob in the store
+// that isn't in that set.
+func Gc() {
+	imagesDir := must(filepath.Abs(ImagesPath))
+	reachable := map[string]bool{}
+
+	// Image names can nest arbitrarily deep (namespaced Hub images like
+	// "todokr/foo", or non-Hub references like "ghcr.io/x/y"), each
+	// adding a directory level under imagesDir, so find every
+	// "manifests" directory rather than assuming a fixed depth.
+	err := filepath.WalkDir(imagesDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() || d.Name() != "manifests" {
+			return nil
+		}
+		manifestEntries, err := os.ReadDir(path)
+		if err != nil {
+			return nil
+		}
+		for _, manifestEntry := range manifestEntries {
+			manifest, err := readImageManifest(filepath.Join(path, manifestEntry.Name()))
+			if err != nil {
+				continue
+			}
+			reachable[manifest.Config] = true
+			for _, l := range manifest.Layers {
+				reachable[l] = true
+			}
+		}
+		return filepath.SkipDir
+	})
+	if err != nil && !os.IsNotExist(err) {
+		noErr(err)
+	}
+
+	blobEntries, err := os.ReadDir(blobsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
+		noErr(err)
+	}
+	removed := 0
+	for _, blobEntry := range blobEntries {
+		digest := "sha256:" + blobEntry.Name()
+		if reachable[digest] {
+			continue
+		}
+		noErr(os.Remove(filepath.Join(blobsDir(), blobEntry.Name())))
+		removed++
+	}
+	log.Printf("gc: removed %d unreferenced blob(s)", removed)
+}
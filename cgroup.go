@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// CGroupV2Root is where the unified cgroup v2 hierarchy is mounted on
+// modern systemd-cgroup-v2 hosts.
+const CGroupV2Root = "/sys/fs/cgroup"
+
+// Cgroup represents a per-container cgroup v2 directory under
+// CGroupV2Root/dockie/<containerId>, used to cap CPU, memory and pids for
+// the container's process tree.
+type Cgroup struct {
+	Dir string
+}
+
+// cgroupV2Available reports whether the host exposes the cgroup v2
+// unified hierarchy (as opposed to the legacy v1 per-controller mounts).
+func cgroupV2Available() bool {
+	_, err := os.Stat(filepath.Join(CGroupV2Root, "cgroup.controllers"))
+	return err == nil
+}
+
+// newCgroup creates dockie/<containerId> under the unified hierarchy and
+// enables the controllers dockie needs in the parent's subtree_control so
+// they show up inside the new cgroup.
+func newCgroup(containerId string) (*Cgroup, error) {
+	if !cgroupV2Available() {
+		return nil, fmt.Errorf("cgroup v2 unified hierarchy not found at %s", CGroupV2Root)
+	}
+
+	dockieDir := filepath.Join(CGroupV2Root, "dockie")
+	noErr(os.MkdirAll(dockieDir, 0755))
+	noErr(os.WriteFile(filepath.Join(dockieDir, "cgroup.subtree_control"), []byte("+cpu +memory +pids"), 0644))
+
+	dir := filepath.Join(dockieDir, containerId)
+	noErr(os.MkdirAll(dir, 0755))
+	return &Cgroup{Dir: dir}, nil
+}
+
+// AddProc moves pid into the cgroup.
+func (cg *Cgroup) AddProc(pid int) {
+	noErr(os.WriteFile(filepath.Join(cg.Dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644))
+}
+
+// SetCpuLimit writes cpu.max as "<quota> <period>", where period is fixed
+// at 100ms and quota is cpus*period, mirroring how Docker derives
+// --cpus from cgroup v1's cfs_quota/cfs_period.
+func (cg *Cgroup) SetCpuLimit(cpus float32) {
+	const periodUs = 100000
+	quotaUs := int(cpus * periodUs)
+	noErr(os.WriteFile(filepath.Join(cg.Dir, "cpu.max"), []byte(fmt.Sprintf("%d %d", quotaUs, periodUs)), 0644))
+	log.Printf("set cpu.max to %d %d", quotaUs, periodUs)
+}
+
+// SetCpuWeight writes cpu.weight, the v2 replacement for cpu shares.
+// cpu.weight ranges [1, 10000] with 100 as the default/neutral value.
+func (cg *Cgroup) SetCpuWeight(weight uint64) {
+	noErr(os.WriteFile(filepath.Join(cg.Dir, "cpu.weight"), []byte(strconv.FormatUint(weight, 10)), 0644))
+	log.Printf("set cpu.weight to %d", weight)
+}
+
+// SetMemLimit writes memory.max and memory.swap.max, parsing suffixed
+// values like "128M" or "1G".
+func (cg *Cgroup) SetMemLimit(mem string) {
+	bytes := parseMemBytes(mem)
+	noErr(os.WriteFile(filepath.Join(cg.Dir, "memory.max"), []byte(strconv.FormatInt(bytes, 10)), 0644))
+	noErr(os.WriteFile(filepath.Join(cg.Dir, "memory.swap.max"), []byte(strconv.FormatInt(bytes, 10)), 0644))
+	log.Printf("set memory.max and memory.swap.max to %s (%d bytes)", mem, bytes)
+}
+
+// SetPidsLimit writes pids.max.
+func (cg *Cgroup) SetPidsLimit(limit int) {
+	noErr(os.WriteFile(filepath.Join(cg.Dir, "pids.max"), []byte(strconv.Itoa(limit)), 0644))
+	log.Printf("set pids.max to %d", limit)
+}
+
+// Destroy removes the cgroup directory. The kernel refuses to rmdir a
+// cgroup with live processes in it, so this must run after the
+// container's process tree has exited.
+func (cg *Cgroup) Destroy() {
+	if err := os.Remove(cg.Dir); err != nil {
+		log.Printf("failed to remove cgroup %s: %v", cg.Dir, err)
+	}
+}
+
+var memSuffixRe = regexp.MustCompile(`(?i)^(\d+)([kmg]?)b?$`)
+
+// parseMemBytes parses suffixed memory sizes such as "128M" or "1G" (as
+// used by RunConfig.Mem) into a raw byte count.
+func parseMemBytes(mem string) int64 {
+	m := memSuffixRe.FindStringSubmatch(mem)
+	if m == nil {
+		log.Panicf("invalid memory size %q", mem)
+	}
+	n := must(strconv.ParseInt(m[1], 10, 64))
+	switch m[2] {
+	case "k", "K":
+		return n * 1024
+	case "m", "M":
+		return n * 1024 * 1024
+	case "g", "G":
+		return n * 1024 * 1024 * 1024
+	default:
+		return n
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Run starts a container with the specified image and command, recording
+// a ContainerState for it so it shows up in `dockie ps`. With a "-d" flag
+// it detaches: the container's stdout/stderr are redirected to log files
+// instead of the host TTY, and Run returns without waiting for it to exit.
+func Run() {
+	detachedFlag, positional := extractBoolFlag(os.Args[2:], "-d")
+
+	id := newContainerId()
+	image := NewImage(positional[0])
+	command := positional[1:]
+
+	cmd := exec.Command("/proc/self/exe", append([]string{"child", "--id=" + id}, positional...)...)
+	cmd.SysProcAttr = &unix.SysProcAttr{
+		// https://gihyo.jp/admin/serial/01/linux_containers/0002
+		Cloneflags: unix.CLONE_NEWUTS | // hostname & domain name
+			unix.CLONE_NEWPID | // PID namespace
+			unix.CLONE_NEWNS, // mount namespace
+	}
+
+	noErr(os.MkdirAll(containerDir(id), 0755))
+	if detachedFlag {
+		cmd.Stdin = nil
+		cmd.Stdout = must(os.Create(filepath.Join(containerDir(id), "stdout.log")))
+		cmd.Stderr = must(os.Create(filepath.Join(containerDir(id), "stderr.log")))
+	} else {
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+
+	noErr(cmd.Start())
+	writeContainerState(ContainerState{
+		Id:        id,
+		Image:     fmt.Sprintf("%s:%s", image.Name, image.Tag),
+		Command:   command,
+		Pid:       cmd.Process.Pid,
+		CreatedAt: time.Now().Format(time.RFC3339),
+		Status:    "running",
+		Rootfs:    containerDir(id),
+		Cgroup:    filepath.Join(CGroupV2Root, "dockie", id),
+	})
+	log.Printf("started container %s", id)
+
+	if detachedFlag {
+		return
+	}
+	noErr(cmd.Wait())
+}
+
+type RunConfig struct {
+	Cpus      *float32
+	Mem       *string
+	PidsLimit *int
+	CpuWeight *uint64
+}
+
+func (conf *RunConfig) SetCpus(cpus float32) {
+	conf.Cpus = &cpus
+}
+func (conf *RunConfig) SetMem(mem string) {
+	conf.Mem = &mem
+}
+func (conf *RunConfig) SetPidsLimit(limit int) {
+	conf.PidsLimit = &limit
+}
+func (conf *RunConfig) SetCpuWeight(weight uint64) {
+	conf.CpuWeight = &weight
+}
+
+// RunChild sets up the container's mount namespace and pivots into it,
+// then execs command. If command is empty, it falls back to the pulled
+// image's config (Entrypoint+Cmd), so callers no longer have to pass an
+// absolute path for images that declare their own entrypoint. containerId
+// is generated by Run and passed down via the "--id=" flag so its
+// ContainerState (already written by Run before this process starts)
+// shares the same rootfs directory.
+func RunChild(containerId string, image Image, command []string, conf RunConfig) {
+	rootDir := containerDir(containerId)
+	noErr(os.MkdirAll(rootDir, 0755))
+	rootFsDir := filepath.Join(rootDir, "rootfs")
+	initDir(rootFsDir)
+	rwDir := filepath.Join(rootDir, "cow_rw")
+	initDir(rwDir)
+	workDir := filepath.Join(rootDir, "cow_workdir")
+	initDir(workDir)
+
+	// コンテナのリソース使用量を制限 (cgroup v2 unified hierarchy)
+	// Destroy is deliberately not deferred here: it runs in Rm, once
+	// isAlive(pid) is false, because the kernel refuses to rmdir a cgroup
+	// while this very process (added below) is still a member of it.
+	cg, err := newCgroup(containerId)
+	if err != nil {
+		log.Printf("cgroup limits disabled: %v", err)
+	} else {
+		cg.AddProc(os.Getpid())
+		if conf.Cpus != nil {
+			cg.SetCpuLimit(*conf.Cpus)
+		}
+		if conf.CpuWeight != nil {
+			cg.SetCpuWeight(*conf.CpuWeight)
+		}
+		if conf.Mem != nil {
+			cg.SetMemLimit(*conf.Mem)
+		}
+		if conf.PidsLimit != nil {
+			cg.SetPidsLimit(*conf.PidsLimit)
+		}
+	}
+
+	// ホスト名をセット
+	noErr(unix.Sethostname([]byte(containerId)))
+
+	// ルートディレクトリをプライベートにマウント
+	// https://kernhack.hatenablog.com/entry/2015/05/30/115705
+	// https://www.kernel.org/doc/html/latest/filesystems/sharedsubtree.html
+	noErr(unix.Mount("rootfs", "/", "", unix.MS_PRIVATE|unix.MS_REC, ""))
+
+	// docker imageのディレクトリをマウント
+	imagesDir := must(filepath.Abs(ImagesPath))
+	imageDir := filepath.Join(imagesDir, image.Name, "layers", "contents", image.Tag)
+	noErr(unix.Mount(
+		"overlay",
+		rootDir,
+		"overlay",
+		unix.MS_NODEV,
+		fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", imageDir, rwDir, workDir)),
+	)
+	// システムディレクトリを構成
+	// /proc: PIDなどプロセスの情報
+	procDir := filepath.Join(rootDir, "proc")
+	initDir(procDir)
+	noErr(unix.Mount("proc", procDir, "proc", 0, ""))
+
+	// /sys: ドライバ関連のプロセスの情報
+	sysDir := filepath.Join(rootDir, "sys")
+	initDir(sysDir)
+	noErr(unix.Mount("sysfs", sysDir, "sysfs", 0, ""))
+
+	// /dev: dev: CPUやメモリなど基本デバイス
+	devDir := filepath.Join(rootDir, "dev")
+	initDir(devDir)
+	noErr(unix.Mount("tmpfs", devDir, "tmpfs", unix.MS_NOSUID|unix.MS_STRICTATIME, "mode=755"))
+	// /dev/null
+	noErr(unix.Mknod(filepath.Join(devDir, "null"), unix.S_IFCHR|0666, int(unix.Mkdev(1, 3))))
+	// /dev/tty
+	noErr(unix.Mknod(filepath.Join(devDir, "tty"), unix.S_IFCHR|0666, int(unix.Mkdev(5, 0))))
+	// /dev/random
+	noErr(unix.Mknod(filepath.Join(devDir, "random"), unix.S_IFCHR|0666, int(unix.Mkdev(1, 8))))
+
+	// pivot_root: 新しいルートディレクトリをセット
+	oldRoot := filepath.Join(rootDir, "oldroot")
+	initDir(oldRoot)
+	noErr(unix.PivotRoot(rootDir, oldRoot))
+	noErr(unix.Chdir("/"))
+	noErr(unix.Unmount("/oldroot", unix.MNT_DETACH))
+
+	env, entrypoint, cmdWorkDir, user := resolveRunConfig(image, command)
+
+	cmd := exec.Command(entrypoint[0], entrypoint[1:]...)
+	cmd.Env = env
+	cmd.Dir = cmdWorkDir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if user != "" {
+		uid, gid := resolveUser(user)
+		cmd.SysProcAttr = &unix.SysProcAttr{Credential: &syscall.Credential{Uid: uid, Gid: gid}}
+	}
+	noErr(cmd.Run())
+}
+
+// resolveRunConfig merges the user-supplied command with the image's
+// cached OCI config, so `dockie run image` works even when the caller
+// doesn't pass an absolute command path.
+func resolveRunConfig(image Image, command []string) (env []string, entrypoint []string, workDir string, user string) {
+	imgConf := image.loadConfig()
+
+	entrypoint = command
+	if len(entrypoint) == 0 {
+		entrypoint = append(append([]string{}, imgConf.Entrypoint...), imgConf.Cmd...)
+	}
+	if len(entrypoint) == 0 {
+		panic("no command given and image config declares no Entrypoint/Cmd")
+	}
+
+	workDir = imgConf.WorkingDir
+	if workDir == "" {
+		workDir = "/"
+	}
+
+	env = imgConf.Env
+	return env, entrypoint, workDir, imgConf.User
+}
+
+// resolveUser parses an ImageConfig.User of the form "<uid|name>[:<gid|group>]"
+// into numeric ids, looking up names against the container's own
+// /etc/passwd and /etc/group — by the time this runs RunChild has already
+// pivot_root'd, so those resolve inside the image, not the host's.
+func resolveUser(spec string) (uid, gid uint32) {
+	userPart, groupPart, hasGroup := strings.Cut(spec, ":")
+
+	if id, err := strconv.ParseUint(userPart, 10, 32); err == nil {
+		uid = uint32(id)
+	} else {
+		u, err := user.Lookup(userPart)
+		if err != nil {
+			log.Panicf("unknown user %q in image config: %v", userPart, err)
+		}
+		uid = uint32(must(strconv.ParseUint(u.Uid, 10, 32)))
+		gid = uint32(must(strconv.ParseUint(u.Gid, 10, 32)))
+	}
+
+	if hasGroup {
+		if id, err := strconv.ParseUint(groupPart, 10, 32); err == nil {
+			gid = uint32(id)
+		} else {
+			g, err := user.LookupGroup(groupPart)
+			if err != nil {
+				log.Panicf("unknown group %q in image config: %v", groupPart, err)
+			}
+			gid = uint32(must(strconv.ParseUint(g.Gid, 10, 32)))
+		}
+	}
+
+	return uid, gid
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// ContainerState is dockie's persistent record of a container, written to
+// .dockie/containers/<id>/state.json when it starts so it can be listed,
+// inspected, execed into or torn down later without re-deriving anything
+// from the image.
+type ContainerState struct {
+	Id        string
+	Image     string
+	Command   []string
+	Pid       int
+	CreatedAt string
+	Status    string
+	Rootfs    string
+	Cgroup    string
+}
+
+// newContainerId generates a random 12-hex-character container id, docker
+// style, so running the same image twice doesn't clobber a previous
+// container's state.
+func newContainerId() string {
+	b := make([]byte, 6)
+	must(rand.Read(b))
+	return hex.EncodeToString(b)
+}
+
+func containerDir(id string) string {
+	return filepath.Join(must(filepath.Abs(ContainerDataPath)), id)
+}
+
+func containerStatePath(id string) string {
+	return filepath.Join(containerDir(id), "state.json")
+}
+
+func writeContainerState(state ContainerState) {
+	noErr(os.MkdirAll(containerDir(state.Id), 0755))
+	body := must(json.Marshal(state))
+	noErr(os.WriteFile(containerStatePath(state.Id), body, 0644))
+}
+
+func readContainerState(id string) (ContainerState, error) {
+	body, err := os.ReadFile(containerStatePath(id))
+	if err != nil {
+		return ContainerState{}, err
+	}
+	var state ContainerState
+	if err := json.Unmarshal(body, &state); err != nil {
+		return ContainerState{}, err
+	}
+	return state, nil
+}
+
+// listContainerStates returns every recorded container, oldest first.
+func listContainerStates() ([]ContainerState, error) {
+	containersDir := must(filepath.Abs(ContainerDataPath))
+	entries, err := os.ReadDir(containersDir)
+	if err != nil {
+		return nil, err
+	}
+	states := make([]ContainerState, 0, len(entries))
+	for _, entry := range entries {
+		state, err := readContainerState(entry.Name())
+		if err != nil {
+			continue
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].CreatedAt < states[j].CreatedAt })
+	return states, nil
+}
+
+// isAlive reports whether pid is a live process, by sending it signal 0
+// (which performs the existence/permission check without actually
+// signalling anything).
+func isAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	return unix.Kill(pid, 0) == nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// whiteoutPrefix marks a deleted file from a lower layer, per the
+// OCI/AUFS whiteout convention: a layer containing ".wh.foo" means "foo
+// is deleted in this layer's view of the filesystem".
+const whiteoutPrefix = ".wh."
+
+// opaqueWhiteoutName marks a directory as opaque: none of the entries for
+// it in lower layers should be visible, only what this layer provides.
+const opaqueWhiteoutName = ".wh..wh..opq"
+
+// overlayOpaqueXattr is the overlayfs xattr that gives a directory the
+// same "opaque" semantics as an OCI opaque whiteout.
+const overlayOpaqueXattr = "trusted.overlay.opaque"
+
+// extractLayer streams a gzipped tar layer from tarGzPath directly into
+// destDir, translating AUFS/OCI whiteouts into their overlayfs
+// equivalents as it goes: a ".wh.foo" entry becomes a 0/0 character
+// device named "foo", and a ".wh..wh..opq" entry sets the overlay opaque
+// xattr on its containing directory instead of being extracted as a file.
+func extractLayer(tarGzPath, destDir string) error {
+	f, err := os.Open(tarGzPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("opening gzip stream: %w", err)
+	}
+	defer func() { _ = gz.Close() }()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar header: %w", err)
+		}
+		if err := extractEntry(tr, hdr, destDir); err != nil {
+			return fmt.Errorf("extracting %s: %w", hdr.Name, err)
+		}
+	}
+}
+
+func extractEntry(tr *tar.Reader, hdr *tar.Header, destDir string) error {
+	name, err := sanitizeEntryPath(destDir, hdr.Name)
+	if err != nil {
+		return err
+	}
+
+	dir, base := filepath.Split(name)
+	if base == opaqueWhiteoutName {
+		return unix.Setxattr(strings.TrimSuffix(dir, "/"), overlayOpaqueXattr, []byte("y"), 0)
+	}
+	if strings.HasPrefix(base, whiteoutPrefix) {
+		target := filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+		_ = os.RemoveAll(target)
+		return unix.Mknod(target, unix.S_IFCHR|0000, int(unix.Mkdev(0, 0)))
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return mkdirWithMode(name, hdr)
+	case tar.TypeReg:
+		return extractRegular(tr, name, hdr)
+	case tar.TypeSymlink:
+		if err := checkSymlinkTargetScope(destDir, name, hdr.Linkname); err != nil {
+			return err
+		}
+		_ = os.Remove(name)
+		if err := os.Symlink(hdr.Linkname, name); err != nil {
+			return err
+		}
+		return lchownEntry(name, hdr)
+	case tar.TypeLink:
+		oldname, err := sanitizeEntryPath(destDir, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		_ = os.Remove(name)
+		return os.Link(oldname, name)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return extractSpecial(name, hdr)
+	default:
+		log.Printf("skipping unsupported tar entry type %q for %s", hdr.Typeflag, hdr.Name)
+		return nil
+	}
+}
+
+func mkdirWithMode(name string, hdr *tar.Header) error {
+	if err := os.MkdirAll(name, os.FileMode(hdr.Mode)); err != nil {
+		return err
+	}
+	if err := os.Chmod(name, os.FileMode(hdr.Mode)); err != nil {
+		return err
+	}
+	return chownAndTimesEntry(name, hdr)
+}
+
+func extractRegular(tr *tar.Reader, name string, hdr *tar.Header) error {
+	noErr(os.MkdirAll(filepath.Dir(name), 0755))
+	_ = os.Remove(name)
+	out, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, tr); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return chownAndTimesEntry(name, hdr)
+}
+
+func extractSpecial(name string, hdr *tar.Header) error {
+	mode := map[byte]uint32{tar.TypeChar: unix.S_IFCHR, tar.TypeBlock: unix.S_IFBLK, tar.TypeFifo: unix.S_IFIFO}[hdr.Typeflag]
+	_ = os.Remove(name)
+	if err := unix.Mknod(name, mode|uint32(hdr.Mode), int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))); err != nil {
+		return err
+	}
+	return chownAndTimesEntry(name, hdr)
+}
+
+func chownAndTimesEntry(name string, hdr *tar.Header) error {
+	if err := os.Lchown(name, hdr.Uid, hdr.Gid); err != nil && !os.IsPermission(err) {
+		return err
+	}
+	return os.Chtimes(name, hdr.AccessTime, modTimeOrNow(hdr))
+}
+
+func lchownEntry(name string, hdr *tar.Header) error {
+	if err := os.Lchown(name, hdr.Uid, hdr.Gid); err != nil && !os.IsPermission(err) {
+		return err
+	}
+	return nil
+}
+
+func modTimeOrNow(hdr *tar.Header) time.Time {
+	if hdr.ModTime.IsZero() {
+		return time.Unix(0, 0)
+	}
+	return hdr.ModTime
+}
+
+// sanitizeEntryPath resolves a tar entry name against destDir, rejecting
+// anything that would escape it: absolute paths and ".." components are
+// neutralized by cleaning against a synthetic root before destDir is ever
+// joined in, and the entry's containing directory is additionally walked
+// component-by-component against the real filesystem (resolveScopedDir)
+// so a symlink planted by an earlier entry (in this layer or a previous
+// one already extracted into destDir) can't be used to redirect this
+// entry outside the extract root. Symlink entries themselves are further
+// guarded by checkSymlinkTargetScope, which rejects a relative Linkname
+// that would escape destDir if dereferenced.
+func sanitizeEntryPath(destDir, entryName string) (string, error) {
+	clean := filepath.Clean(string(filepath.Separator) + entryName)
+	if clean == string(filepath.Separator) {
+		return destDir, nil
+	}
+	dir, base := filepath.Split(strings.TrimPrefix(clean, string(filepath.Separator)))
+	resolvedDir, err := resolveScopedDir(destDir, dir)
+	if err != nil {
+		return "", err
+	}
+	final := filepath.Join(resolvedDir, base)
+	if final != destDir && !strings.HasPrefix(final, destDir+string(filepath.Separator)) {
+		return "", fmt.Errorf("illegal path traversal: %s", entryName)
+	}
+	return final, nil
+}
+
+// checkSymlinkTargetScope rejects a relative symlink target that would
+// escape destDir if something ever dereferenced it, e.g. a layer entry
+// "a/b/evil -> ../../../../etc" pointing several levels above destDir.
+// Absolute targets (like "/bin/busybox") are always allowed: they're
+// meaningless until the image is later chrooted into, at which point they
+// correctly resolve against the container's own root, not destDir — it's
+// only relative targets that resolveScopedDir can't fully protect against,
+// since they take effect the instant they're dereferenced rather than
+// being walked component-by-component like a tar entry name is.
+func checkSymlinkTargetScope(destDir, name, target string) error {
+	if filepath.IsAbs(target) {
+		return nil
+	}
+	dir := filepath.Dir(name)
+	resolved := filepath.Join(dir, target)
+	if resolved == destDir || strings.HasPrefix(resolved, destDir+string(filepath.Separator)) {
+		return nil
+	}
+	return fmt.Errorf("illegal symlink target escapes extract root: %s -> %s", name, target)
+}
+
+// resolveScopedDir walks rel (a directory path already cleaned relative
+// to the extract root) one component at a time starting at root,
+// following symlinks that already exist on disk but clamping their
+// target back under root exactly as a chroot would — so a layer entry
+// that plants "evil -> /" can't have a later entry like "evil/etc/passwd"
+// resolve through it onto the host filesystem.
+func resolveScopedDir(root, rel string) (string, error) {
+	current := root
+	for _, part := range strings.Split(filepath.Clean(rel), string(filepath.Separator)) {
+		if part == "" || part == "." {
+			continue
+		}
+		parent := current
+		next := filepath.Join(parent, part)
+		info, err := os.Lstat(next)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			// doesn't exist yet, or is a plain directory: nothing to resolve
+			current = next
+			continue
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			current = filepath.Join(root, target)
+		} else {
+			current = filepath.Join(parent, target)
+		}
+		if current != root && !strings.HasPrefix(current, root+string(filepath.Separator)) {
+			current = root // clamp any escape back to root, as a chroot would
+		}
+	}
+	return current, nil
+}
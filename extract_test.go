@@ -0,0 +1,203 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSanitizeEntryPath(t *testing.T) {
+	destDir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		entry   string
+		want    string
+		wantErr bool
+	}{
+		{"plain relative path", "etc/passwd", filepath.Join(destDir, "etc/passwd"), false},
+		{"absolute path is neutralized", "/etc/passwd", filepath.Join(destDir, "etc/passwd"), false},
+		{"leading dotdot is neutralized", "../../etc/passwd", filepath.Join(destDir, "etc/passwd"), false},
+		{"root entry", ".", destDir, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sanitizeEntryPath(destDir, tt.entry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sanitizeEntryPath(%q) error = %v, wantErr %v", tt.entry, err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("sanitizeEntryPath(%q) = %q, want %q", tt.entry, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeEntryPath_SymlinkEscapeIsClamped(t *testing.T) {
+	destDir := t.TempDir()
+	if err := os.Symlink("/", filepath.Join(destDir, "evil")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := sanitizeEntryPath(destDir, "evil/etc/passwd")
+	if err != nil {
+		t.Fatalf("sanitizeEntryPath returned an error instead of a clamped path: %v", err)
+	}
+	want := filepath.Join(destDir, "etc/passwd")
+	if got != want {
+		t.Errorf("sanitizeEntryPath(%q) = %q, want %q (real symlink to / must not escape destDir)", "evil/etc/passwd", got, want)
+	}
+}
+
+func TestResolveScopedDir(t *testing.T) {
+	root := t.TempDir()
+
+	if got, err := resolveScopedDir(root, "a/b"); err != nil || got != filepath.Join(root, "a/b") {
+		t.Errorf("resolveScopedDir with no symlinks = (%q, %v), want (%q, nil)", got, err, filepath.Join(root, "a/b"))
+	}
+
+	if err := os.Symlink("/", filepath.Join(root, "abs-escape")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := resolveScopedDir(root, "abs-escape/etc"); err != nil || got != filepath.Join(root, "etc") {
+		t.Errorf("resolveScopedDir should clamp an absolute symlink escape back to root, got (%q, %v)", got, err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../../../../..", filepath.Join(root, "a", "rel-escape")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := resolveScopedDir(root, "a/rel-escape/etc"); err != nil || got != filepath.Join(root, "etc") {
+		t.Errorf("resolveScopedDir should clamp a relative symlink escape back to root, got (%q, %v)", got, err)
+	}
+}
+
+func TestCheckSymlinkTargetScope(t *testing.T) {
+	destDir := "/dest"
+
+	if err := checkSymlinkTargetScope(destDir, filepath.Join(destDir, "bin/sh"), "/bin/busybox"); err != nil {
+		t.Errorf("absolute targets must always be allowed, got error: %v", err)
+	}
+	if err := checkSymlinkTargetScope(destDir, filepath.Join(destDir, "a/evil"), "../b"); err != nil {
+		t.Errorf("an in-scope relative target must be allowed, got error: %v", err)
+	}
+	if err := checkSymlinkTargetScope(destDir, filepath.Join(destDir, "a/evil"), "../../etc/passwd"); err == nil {
+		t.Error("a relative target that escapes destDir must be rejected, not silently truncated")
+	}
+}
+
+func newTestLayer(t *testing.T, headers []*tar.Header, contents map[string][]byte) string {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, hdr := range headers {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if body, ok := contents[hdr.Name]; ok {
+			if _, err := tw.Write(body); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "layer.tar.gz")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestExtractLayer_SymlinkEscapeIsContained is a regression test for the
+// path-traversal vulnerability fixed by chunk0-5: a layer planting "evil
+// -> /" followed by a regular file under "evil/" must never write outside
+// destDir, even though both entries individually look innocuous.
+func TestExtractLayer_SymlinkEscapeIsContained(t *testing.T) {
+	payload := []byte("pwned")
+	tarPath := newTestLayer(t,
+		[]*tar.Header{
+			{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: "/", Mode: 0777},
+			{Name: "evil/etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(payload))},
+		},
+		map[string][]byte{"evil/etc/passwd": payload},
+	)
+
+	destDir := t.TempDir()
+	if err := extractLayer(tarPath, destDir); err != nil {
+		t.Fatalf("extractLayer: %v", err)
+	}
+
+	if _, err := os.Stat("/etc/.dockie-test-canary"); err == nil {
+		t.Fatal("canary file should not exist")
+	}
+	got, err := os.ReadFile(filepath.Join(destDir, "etc", "passwd"))
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("payload should land inside destDir/etc/passwd, got %q, err %v", got, err)
+	}
+}
+
+func TestExtractLayer_RegularFilesAndDirs(t *testing.T) {
+	payload := []byte("hello")
+	tarPath := newTestLayer(t,
+		[]*tar.Header{
+			{Name: "bin", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "bin/hello", Typeflag: tar.TypeReg, Mode: 0755, Size: int64(len(payload))},
+		},
+		map[string][]byte{"bin/hello": payload},
+	)
+
+	destDir := t.TempDir()
+	if err := extractLayer(tarPath, destDir); err != nil {
+		t.Fatalf("extractLayer: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(destDir, "bin", "hello"))
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("expected bin/hello to contain %q, got %q, err %v", payload, got, err)
+	}
+}
+
+// TestExtractLayer_Whiteout exercises the AUFS/OCI whiteout translation.
+// It's skipped where the sandbox lacks CAP_MKNOD, since char-device
+// creation is what a ".wh." entry translates into.
+func TestExtractLayer_Whiteout(t *testing.T) {
+	destDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(destDir, "foo"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tarPath := newTestLayer(t, []*tar.Header{
+		{Name: ".wh.foo", Typeflag: tar.TypeReg, Mode: 0644},
+	}, nil)
+
+	err := extractLayer(tarPath, destDir)
+	if err != nil {
+		if errors.Is(err, unix.EPERM) || errors.Is(err, unix.ENOTSUP) {
+			t.Skipf("sandbox doesn't permit mknod: %v", err)
+		}
+		t.Fatalf("extractLayer: %v", err)
+	}
+
+	info, err := os.Lstat(filepath.Join(destDir, "foo"))
+	if err != nil {
+		t.Fatalf("whiteout device node should replace foo: %v", err)
+	}
+	if info.Mode()&os.ModeCharDevice == 0 {
+		t.Errorf("foo should have been replaced by a char device whiteout marker, got mode %v", info.Mode())
+	}
+}
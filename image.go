@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Manifest struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int    `json:"size"`
+	PlatForm  struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		Variant      string `json:"variant"`
+	} `json:"platform"`
+}
+
+const (
+	MediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// manifestAcceptHeader lists every media type dockie knows how to parse, so
+// the registry can hand back either a multi-arch index/list or a
+// single-arch manifest directly.
+const manifestAcceptHeader = MediaTypeOCIIndex + ", " + MediaTypeDockerManifestList + ", " + MediaTypeOCIManifest + ", " + MediaTypeDockerManifest
+
+type Layer struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int    `json:"size"`
+}
+
+type Image struct {
+	// Name is the image reference as given on the command line, e.g.
+	// "nginx", "todokr/foo" or "ghcr.io/todokr/foo".
+	Name string
+	Tag  string
+	Dir  ImageDirs
+	// Registry is the host to talk to, resolved from Name (defaulting to
+	// DefaultRegistryHost).
+	Registry string
+	// Repo is the repository path on Registry, resolved from Name
+	// (namespaced under DefaultNamespace when Name omitted one).
+	Repo  string
+	Token string
+}
+
+// NewImage resolves a "name:tag" image reference into registry host and
+// repo path, defaulting the tag to "latest" when omitted.
+func NewImage(ref string) Image {
+	name, tag := splitRefTag(ref)
+	registryHost, repo := parseImageName(name)
+	return Image{Name: name, Tag: tag, Registry: registryHost, Repo: repo}
+}
+
+// splitRefTag splits "name:tag" into its parts, defaulting to "latest"
+// when no tag is given. It splits on the last ":" after the last "/" so a
+// registry host:port (e.g. "localhost:5000/foo") isn't mistaken for a tag.
+func splitRefTag(ref string) (name, tag string) {
+	slash := strings.LastIndex(ref, "/")
+	colon := strings.LastIndex(ref, ":")
+	if colon > slash {
+		return ref[:colon], ref[colon+1:]
+	}
+	return ref, "latest"
+}
+
+type ImageDirs struct {
+	// ImageDir is the directory for the image
+	ImageDir string
+	// LayersDir is the directory for all layers
+	LayersDir string
+	// ContentsDir is the directory for all contents
+	ContentsDir string
+	// ManifestsDir holds one resolved ImageManifest per tag
+	ManifestsDir string
+}
+
+// ImageManifest is dockie's own record of what a pulled tag resolved to:
+// the config blob and the ordered layer blobs, all addressed by digest in
+// the shared blob store. It lets Gc compute the reachable set without
+// re-talking to the registry, and lets RunChild load the image config
+// without re-pulling it.
+type ImageManifest struct {
+	Config string   `json:"config"`
+	Layers []string `json:"layers"`
+}
+
+// ImageConfig is the subset of the OCI image config
+// (application/vnd.oci.image.config.v1+json) that dockie honours when
+// starting a container. User is "<uid|name>[:<gid|group>]", resolved by
+// resolveUser against the container's own /etc/passwd once chrooted in.
+type ImageConfig struct {
+	Env        []string `json:"Env"`
+	Cmd        []string `json:"Cmd"`
+	Entrypoint []string `json:"Entrypoint"`
+	WorkingDir string   `json:"WorkingDir"`
+	User       string   `json:"User"`
+}
+
+func (image *Image) setupImageDir() {
+	imagesDir := must(filepath.Abs(ImagesPath))
+	imageDir := filepath.Join(imagesDir, image.Name)
+	noErr(os.MkdirAll(imageDir, 0755))
+	layersDir := filepath.Join(imageDir, "layers")
+	noErr(os.MkdirAll(layersDir, 0755))
+	contentsDir := filepath.Join(layersDir, "contents")
+	noErr(os.MkdirAll(contentsDir, 0755))
+	manifestsDir := filepath.Join(imageDir, "manifests")
+	noErr(os.MkdirAll(manifestsDir, 0755))
+	image.Dir = ImageDirs{
+		ImageDir:     imageDir,
+		LayersDir:    layersDir,
+		ContentsDir:  contentsDir,
+		ManifestsDir: manifestsDir,
+	}
+}
+
+func (image *Image) manifestPath() string {
+	return filepath.Join(image.Dir.ManifestsDir, image.Tag+".json")
+}
+
+func writeImageManifest(path string, manifest ImageManifest) {
+	noErr(os.MkdirAll(filepath.Dir(path), 0755))
+	body := must(json.Marshal(manifest))
+	noErr(os.WriteFile(path, body, 0644))
+}
+
+func readImageManifest(path string) (ImageManifest, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return ImageManifest{}, err
+	}
+	var manifest ImageManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return ImageManifest{}, err
+	}
+	return manifest, nil
+}
+
+// loadConfig reads the image's cached OCI config, which downloadLayers
+// stores in the blob store alongside the layers.
+func (image *Image) loadConfig() ImageConfig {
+	manifest, err := readImageManifest(image.manifestPath())
+	if err != nil {
+		log.Panicf("no manifest recorded for %s:%s, pull it first. err=%v", image.Name, image.Tag, err)
+	}
+	body := must(os.ReadFile(blobPath(manifest.Config)))
+	var conf ImageConfig
+	noErr(json.Unmarshal(body, &conf))
+	return conf
+}
+
+// fetchManifest fetches the manifest/index/list at url, requesting every
+// media type dockie understands via the Accept header, and returns both
+// the body and the Content-Type the registry actually chose to send.
+func fetchManifest(url, token string) (body []byte, mediaType string) {
+	req, _ := http.NewRequest("GET", url, nil)
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+	req.Header.Set("Accept", manifestAcceptHeader)
+	res := must(http.DefaultClient.Do(req))
+	if res.StatusCode != http.StatusOK {
+		log.Panicf("failed to fetch %s. status=%s", url, res.Status)
+	}
+	defer func() { _ = res.Body.Close() }()
+	body = must(io.ReadAll(res.Body))
+	mediaType = strings.TrimSpace(strings.SplitN(res.Header.Get("Content-Type"), ";", 2)[0])
+	return body, mediaType
+}
+
+// resolveSingleArchManifest fetches the (image-)manifest at url, following
+// one level of image index/manifest-list indirection and picking the
+// entry matching platform, and returns its config digest and layer
+// digests. It understands both the OCI and Docker v2 manifest schemas,
+// which share the same field names for what dockie needs.
+func (image *Image) resolveSingleArchManifest(url, token string, platform Platform) (configDigest string, layerDigests []string) {
+	body, mediaType := fetchManifest(url, token)
+
+	switch mediaType {
+	case MediaTypeOCIIndex, MediaTypeDockerManifestList:
+		var ires struct {
+			Manifests []Manifest `json:"manifests"`
+		}
+		if err := json.Unmarshal(body, &ires); err != nil {
+			log.Panicf("failed to unmarshal image index/manifest list. url=%s, body=%v, err=%v", url, body, err)
+		}
+		entry, ok := selectManifest(ires.Manifests, platform)
+		if !ok {
+			log.Panicf("no manifest for platform %s at %s", platform, url)
+		}
+		blobUrl := fmt.Sprintf("https://%s/v2/%s/manifests/%s", image.Registry, image.Repo, entry.Digest)
+		return image.resolveSingleArchManifest(blobUrl, token, platform)
+
+	case MediaTypeOCIManifest, MediaTypeDockerManifest:
+		var mres struct {
+			Config struct {
+				Digest string `json:"digest"`
+			} `json:"config"`
+			Layers []Layer `json:"layers"`
+		}
+		if err := json.Unmarshal(body, &mres); err != nil {
+			log.Panicf("failed to unmarshal manifest. url=%s, body=%v, err=%v", url, body, err)
+		}
+		for _, layer := range mres.Layers {
+			if layer.MediaType != "application/vnd.oci.image.layer.v1.tar+gzip" && layer.MediaType != "application/vnd.docker.image.rootfs.diff.tar.gzip" {
+				log.Printf("skipping media type %q (%s)\n", layer.MediaType, layer.Digest)
+				continue
+			}
+			layerDigests = append(layerDigests, layer.Digest)
+		}
+		return mres.Config.Digest, layerDigests
+
+	default:
+		log.Panicf("unsupported manifest media type %q for %s:%s (url=%s)", mediaType, image.Name, image.Tag, url)
+		return "", nil
+	}
+}
+
+// downloadLayers downloads the layers of the image and unpacks them
+func (image *Image) downloadLayers(platform Platform) {
+	url := fmt.Sprintf("https://%s/v2/%s/manifests/%s", image.Registry, image.Repo, image.Tag)
+	log.Printf("fetching manifest for %s from %s", platform, url)
+	configDigest, layerDigests := image.resolveSingleArchManifest(url, image.Token, platform)
+
+	if configDigest != "" {
+		url := fmt.Sprintf("https://%s/v2/%s/blobs/%s", image.Registry, image.Repo, configDigest)
+		fetchBlob(url, image.Token, configDigest)
+	}
+
+	unpackDir := filepath.Join(image.Dir.ContentsDir, image.Tag)
+	initDir(unpackDir)
+	for _, digest := range layerDigests {
+		url := fmt.Sprintf("https://%s/v2/%s/blobs/%s", image.Registry, image.Repo, digest)
+		tarFile := fetchBlob(url, image.Token, digest)
+		noErr(extractLayer(tarFile, unpackDir))
+	}
+
+	writeImageManifest(image.manifestPath(), ImageManifest{
+		Config: configDigest,
+		Layers: layerDigests,
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Ps lists known containers. Only running ones are shown unless all is
+// set, matching `docker ps [-a]`.
+func Ps(all bool) {
+	states := must(listContainerStates())
+	fmt.Printf("%-14s%-20s%-24s%-16s%s\n", "CONTAINER ID", "IMAGE", "COMMAND", "STATUS", "CREATED")
+	for _, state := range states {
+		alive := isAlive(state.Pid)
+		if !all && !alive {
+			continue
+		}
+		status := "Exited"
+		if alive {
+			status = fmt.Sprintf("Up (pid %d)", state.Pid)
+		}
+		fmt.Printf("%-14s%-20s%-24s%-16s%s\n", state.Id, state.Image, strings.Join(state.Command, " "), status, state.CreatedAt)
+	}
+}
+
+// Rm tears down a stopped container: unmounts what's left of its rootfs
+// (its mounts normally die with the container's own mount namespace, but
+// we try anyway in case any leaked into the host namespace), removes its
+// cgroup, and deletes its state directory.
+func Rm(id string) {
+	state, err := readContainerState(id)
+	if err != nil {
+		log.Panicf("no such container %q: %v", id, err)
+	}
+	if isAlive(state.Pid) {
+		log.Panicf("container %s is still running (pid %d), stop it first", id, state.Pid)
+	}
+
+	for _, sub := range []string{"dev", "sys", "proc"} {
+		_ = unix.Unmount(filepath.Join(state.Rootfs, sub), unix.MNT_DETACH)
+	}
+	_ = unix.Unmount(state.Rootfs, unix.MNT_DETACH)
+
+	if state.Cgroup != "" {
+		(&Cgroup{Dir: state.Cgroup}).Destroy()
+	}
+
+	noErr(os.RemoveAll(containerDir(id)))
+	log.Printf("removed container %s", id)
+}
+
+// Logs prints a detached container's captured stdout/stderr, as
+// redirected there by RunChild when started with -d.
+func Logs(id string) {
+	for _, name := range []string{"stdout.log", "stderr.log"} {
+		body, err := os.ReadFile(filepath.Join(containerDir(id), name))
+		if err != nil {
+			continue
+		}
+		must(os.Stdout.Write(body))
+	}
+}
+
+// Exec joins the mount, uts and pid namespaces of a running container's
+// init process and runs command inside them. Joining the pid namespace
+// only takes effect for processes forked after the Setns call, so this
+// must run on a locked OS thread and exec the new process itself rather
+// than letting it hop threads first. Setns(mnt) alone only switches which
+// mount table this process sees, not its root directory: after the
+// container pivot_root'd, state.Rootfs (its pre-pivot host path) no
+// longer names anything inside that mount namespace, so the new root is
+// reached by fchdir-ing to the init process's /proc/<pid>/root (its root
+// directory, seen from outside the namespace) and chrooting to ".".
+func Exec(id string, command []string) {
+	if len(command) == 0 {
+		log.Panic("exec: no command given")
+	}
+	state, err := readContainerState(id)
+	if err != nil {
+		log.Panicf("no such container %q: %v", id, err)
+	}
+	if !isAlive(state.Pid) {
+		log.Panicf("container %s is not running", id)
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	for _, ns := range []string{"mnt", "uts", "pid"} {
+		fd := must(unix.Open(fmt.Sprintf("/proc/%d/ns/%s", state.Pid, ns), unix.O_RDONLY, 0))
+		noErr(unix.Setns(fd, 0))
+		noErr(unix.Close(fd))
+	}
+
+	rootFd := must(unix.Open(fmt.Sprintf("/proc/%d/root", state.Pid), unix.O_RDONLY|unix.O_DIRECTORY, 0))
+	noErr(unix.Fchdir(rootFd))
+	noErr(unix.Close(rootFd))
+	noErr(unix.Chroot("."))
+	noErr(unix.Chdir("/"))
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	noErr(cmd.Run())
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+)
+
+// Platform identifies a target OS/architecture/variant triple, e.g.
+// linux/arm64/v8. Variant is optional.
+type Platform struct {
+	OS      string
+	Arch    string
+	Variant string
+}
+
+func (p Platform) String() string {
+	if p.Variant == "" {
+		return fmt.Sprintf("%s/%s", p.OS, p.Arch)
+	}
+	return fmt.Sprintf("%s/%s/%s", p.OS, p.Arch, p.Variant)
+}
+
+// hostPlatform is the platform dockie runs on, used as the default when
+// --platform isn't given.
+func hostPlatform() Platform {
+	return Platform{OS: runtime.GOOS, Arch: runtime.GOARCH}
+}
+
+// parsePlatform parses a user-supplied "--platform os/arch[/variant]" value.
+func parsePlatform(s string) Platform {
+	parts := strings.Split(s, "/")
+	p := Platform{OS: parts[0]}
+	if len(parts) > 1 {
+		p.Arch = parts[1]
+	}
+	if len(parts) > 2 {
+		p.Variant = parts[2]
+	}
+	return p
+}
+
+// matchScore scores how well candidate satisfies wanted, similarly to
+// containers/image's platform matcher: os and arch must match exactly,
+// variant is preferred but not required (an entry with no variant can
+// still serve a request for a specific variant, just less precisely).
+// Returns -1 when the entry can't satisfy the request at all.
+func matchScore(wanted, candidate Platform) int {
+	if candidate.OS != wanted.OS || candidate.Arch != wanted.Arch {
+		return -1
+	}
+	if wanted.Variant == "" || wanted.Variant == candidate.Variant {
+		return 2
+	}
+	if candidate.Variant == "" {
+		return 1
+	}
+	return -1
+}
+
+// selectManifest picks the entry from a manifest list/index that best
+// matches wanted, falling back to no match (ok=false) when nothing in
+// the list targets the requested platform at all.
+func selectManifest(entries []Manifest, wanted Platform) (best Manifest, ok bool) {
+	bestScore := -1
+	for _, entry := range entries {
+		candidate := Platform{OS: entry.PlatForm.OS, Arch: entry.PlatForm.Architecture, Variant: entry.PlatForm.Variant}
+		score := matchScore(wanted, candidate)
+		if score > bestScore {
+			bestScore = score
+			best = entry
+			ok = true
+		}
+	}
+	if !ok {
+		log.Printf("no manifest matches platform %s among %d candidate(s)", wanted, len(entries))
+	}
+	return best, ok
+}
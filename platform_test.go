@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestMatchScore(t *testing.T) {
+	linuxAmd64 := Platform{OS: "linux", Arch: "amd64"}
+
+	tests := []struct {
+		name      string
+		wanted    Platform
+		candidate Platform
+		want      int
+	}{
+		{"exact match, no variant wanted", linuxAmd64, linuxAmd64, 2},
+		{"os mismatch", linuxAmd64, Platform{OS: "darwin", Arch: "amd64"}, -1},
+		{"arch mismatch", linuxAmd64, Platform{OS: "linux", Arch: "arm64"}, -1},
+		{"variant matches exactly", Platform{OS: "linux", Arch: "arm", Variant: "v7"}, Platform{OS: "linux", Arch: "arm", Variant: "v7"}, 2},
+		{"variant wanted, candidate has none", Platform{OS: "linux", Arch: "arm", Variant: "v7"}, Platform{OS: "linux", Arch: "arm"}, 1},
+		{"variant wanted, candidate has a different one", Platform{OS: "linux", Arch: "arm", Variant: "v7"}, Platform{OS: "linux", Arch: "arm", Variant: "v8"}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchScore(tt.wanted, tt.candidate); got != tt.want {
+				t.Errorf("matchScore(%v, %v) = %d, want %d", tt.wanted, tt.candidate, got, tt.want)
+			}
+		})
+	}
+}
+
+func manifestFor(os, arch, variant string) Manifest {
+	m := Manifest{}
+	m.PlatForm.OS = os
+	m.PlatForm.Architecture = arch
+	m.PlatForm.Variant = variant
+	return m
+}
+
+func TestSelectManifest(t *testing.T) {
+	entries := []Manifest{
+		manifestFor("linux", "arm64", ""),
+		manifestFor("linux", "amd64", ""),
+		manifestFor("darwin", "amd64", ""),
+	}
+
+	best, ok := selectManifest(entries, Platform{OS: "linux", Arch: "amd64"})
+	if !ok || best.PlatForm.OS != "linux" || best.PlatForm.Architecture != "amd64" {
+		t.Fatalf("selectManifest returned %+v, ok=%v; want the linux/amd64 entry", best, ok)
+	}
+
+	if _, ok := selectManifest(entries, Platform{OS: "windows", Arch: "amd64"}); ok {
+		t.Fatal("selectManifest should report no match for a platform absent from entries")
+	}
+
+	if _, ok := selectManifest(nil, Platform{OS: "linux", Arch: "amd64"}); ok {
+		t.Fatal("selectManifest should report no match against an empty entry list")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// DefaultRegistryHost is used when an image reference doesn't name one
+// explicitly, e.g. "nginx" or "todokr/foo".
+const DefaultRegistryHost = "registry-1.docker.io"
+
+// DefaultNamespace is prepended to single-component repos against the
+// default registry, e.g. "nginx" -> "library/nginx".
+const DefaultNamespace = "library"
+
+// parseImageName splits a user-supplied image reference such as
+// "ghcr.io/todokr/foo", "todokr/foo" or "nginx" into the registry host to
+// talk to and the repository path on that registry.
+func parseImageName(name string) (registryHost, repo string) {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && looksLikeHost(parts[0]) {
+		registryHost, repo = parts[0], parts[1]
+	} else {
+		registryHost, repo = DefaultRegistryHost, name
+	}
+	if registryHost == DefaultRegistryHost && !strings.Contains(repo, "/") {
+		repo = DefaultNamespace + "/" + repo
+	}
+	return registryHost, repo
+}
+
+// looksLikeHost reports whether the first path component of an image
+// reference names a registry host rather than a Docker Hub namespace,
+// mirroring the moby/distribution heuristic: it's a host if it contains a
+// "." or ":" (a domain or a host:port) or is literally "localhost".
+func looksLikeHost(s string) bool {
+	return s == "localhost" || strings.ContainsAny(s, ".:")
+}
+
+// authChallenge is a parsed `WWW-Authenticate: Bearer realm=...` header as
+// returned by a 401 from a distribution-spec registry.
+// See: https://distribution.github.io/distribution/spec/auth/token/
+type authChallenge struct {
+	Realm   string
+	Service string
+	Scope   string
+}
+
+var challengeParamRe = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+func parseAuthChallenge(header string) (authChallenge, bool) {
+	if !strings.HasPrefix(header, "Bearer ") {
+		return authChallenge{}, false
+	}
+	var c authChallenge
+	for _, m := range challengeParamRe.FindAllStringSubmatch(header, -1) {
+		switch m[1] {
+		case "realm":
+			c.Realm = m[2]
+		case "service":
+			c.Service = m[2]
+		case "scope":
+			c.Scope = m[2]
+		}
+	}
+	return c, c.Realm != ""
+}
+
+// loadToken retrieves and sets a Bearer token to pull images from the
+// container registry by performing the standard token-auth handshake:
+// probe the manifest endpoint unauthenticated, and if it challenges with
+// a 401 Www-Authenticate header, fetch a token from the realm it names.
+// See also: https://distribution.github.io/distribution/spec/auth/token/
+func (image *Image) loadToken() {
+	probeUrl := fmt.Sprintf("https://%s/v2/%s/manifests/%s", image.Registry, image.Repo, image.Tag)
+	req := must(http.NewRequest("GET", probeUrl, nil))
+	res := must(http.DefaultClient.Do(req))
+	defer func() { _ = res.Body.Close() }()
+
+	if res.StatusCode != http.StatusUnauthorized {
+		// registry doesn't require auth for this repo (e.g. an open self-hosted registry)
+		return
+	}
+	challenge, ok := parseAuthChallenge(res.Header.Get("Www-Authenticate"))
+	if !ok {
+		log.Panicf("registry %s returned 401 without a Bearer challenge we understand", image.Registry)
+	}
+
+	tokenUrl := fmt.Sprintf("%s?service=%s&scope=%s", challenge.Realm, challenge.Service, challenge.Scope)
+	log.Printf("fetching token from %s", tokenUrl)
+	tokenReq := must(http.NewRequest("GET", tokenUrl, nil))
+	if user, pass, ok := dockerCredentials(image.Registry); ok {
+		tokenReq.SetBasicAuth(user, pass)
+	}
+	tokenRes := must(http.DefaultClient.Do(tokenReq))
+	if tokenRes.StatusCode != http.StatusOK {
+		log.Panicf("failed to fetch token. status=%s", tokenRes.Status)
+	}
+	defer func() { _ = tokenRes.Body.Close() }()
+	body := must(io.ReadAll(tokenRes.Body))
+	var tres struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &tres); err != nil {
+		log.Panicf("failed to unmarshal token response. body=%v, err=%v", body, err)
+	}
+	if tres.Token != "" {
+		image.Token = tres.Token
+	} else {
+		image.Token = tres.AccessToken
+	}
+}
+
+// dockerCredentials looks up Basic-auth credentials for registryHost, first
+// from DOCKER_USERNAME/DOCKER_PASSWORD, then from the "auths" section of
+// ~/.docker/config.json (keyed by host, falling back to Docker Hub's
+// legacy key for the default registry).
+func dockerCredentials(registryHost string) (user, pass string, ok bool) {
+	if u, p := os.Getenv("DOCKER_USERNAME"), os.Getenv("DOCKER_PASSWORD"); u != "" {
+		return u, p, true
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", "", false
+	}
+	body, err := os.ReadFile(filepath.Join(home, ".docker", "config.json"))
+	if err != nil {
+		return "", "", false
+	}
+	var conf struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(body, &conf); err != nil {
+		return "", "", false
+	}
+
+	keys := []string{registryHost}
+	if registryHost == DefaultRegistryHost {
+		keys = append(keys, "https://index.docker.io/v1/")
+	}
+	for _, key := range keys {
+		entry, found := conf.Auths[key]
+		if !found || entry.Auth == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			continue
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		return parts[0], parts[1], true
+	}
+	return "", "", false
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestParseImageName(t *testing.T) {
+	tests := []struct {
+		name     string
+		ref      string
+		wantHost string
+		wantRepo string
+	}{
+		{"bare name gets library namespace", "nginx", DefaultRegistryHost, "library/nginx"},
+		{"hub namespace/repo", "todokr/foo", DefaultRegistryHost, "todokr/foo"},
+		{"explicit non-hub host", "ghcr.io/todokr/foo", "ghcr.io", "todokr/foo"},
+		{"host:port", "localhost:5000/foo", "localhost:5000", "foo"},
+		{"bare localhost", "localhost/foo", "localhost", "foo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotHost, gotRepo := parseImageName(tt.ref)
+			if gotHost != tt.wantHost || gotRepo != tt.wantRepo {
+				t.Errorf("parseImageName(%q) = (%q, %q), want (%q, %q)", tt.ref, gotHost, gotRepo, tt.wantHost, tt.wantRepo)
+			}
+		})
+	}
+}
+
+func TestParseAuthChallenge(t *testing.T) {
+	header := `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull"`
+	c, ok := parseAuthChallenge(header)
+	if !ok {
+		t.Fatal("expected a valid challenge")
+	}
+	if c.Realm != "https://auth.docker.io/token" || c.Service != "registry.docker.io" || c.Scope != "repository:library/nginx:pull" {
+		t.Errorf("parseAuthChallenge(%q) = %+v", header, c)
+	}
+
+	if _, ok := parseAuthChallenge(`Basic realm="foo"`); ok {
+		t.Error("non-Bearer challenges should be rejected")
+	}
+	if _, ok := parseAuthChallenge(""); ok {
+		t.Error("empty header should be rejected")
+	}
+}
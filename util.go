@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+func fetch(url, token string) *http.Response {
+	req, _ := http.NewRequest("GET", url, nil)
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+	res := must(http.DefaultClient.Do(req))
+	if res.StatusCode != http.StatusOK {
+		log.Panicf("failed to fetch %s. status=%s", url, res.Status)
+	}
+	return res
+}
+
+func must[T any](obj T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return obj
+}
+
+func noErr(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func initDir(dir string) {
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		noErr(os.RemoveAll(dir))
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		noErr(os.MkdirAll(dir, 0755))
+	}
+}